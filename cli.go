@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// repeatableFlag collects every occurrence of a flag that may be passed
+// more than once, e.g. -input-udp=127.0.0.1:3569 -input-udp=127.0.0.1:3570.
+type repeatableFlag []string
+
+func (r *repeatableFlag) String() string {
+	return fmt.Sprint([]string(*r))
+}
+
+func (r *repeatableFlag) Set(value string) error {
+	*r = append(*r, value)
+	return nil
+}
+
+var (
+	inputUDP        repeatableFlag
+	inputUDPWorkers int
+	inputTCP        repeatableFlag
+	inputHTTP       repeatableFlag
+	inputReplay     repeatableFlag
+	replayPaced     bool
+	outputFile      repeatableFlag
+	outputStdout    bool
+	outputNull      bool
+)
+
+func init() {
+	flag.Var(&inputUDP, "input-udp", "listen for the \"name value\" UDP protocol on ip:port (repeatable)")
+	flag.IntVar(&inputUDPWorkers, "input-udp-workers", 1, "number of SO_REUSEPORT sockets per -input-udp address, for multi-core ingestion")
+	flag.Var(&inputTCP, "input-tcp", "listen for newline-delimited payloads on ip:port (repeatable)")
+	flag.Var(&inputHTTP, "input-http", "accept newline-delimited payloads via HTTP POST on ip:port (repeatable)")
+	flag.Var(&inputReplay, "input-replay", "replay payloads from a file, or - for stdin (repeatable)")
+	flag.BoolVar(&replayPaced, "input-replay-paced", false, "pace -input-replay by its leading unix timestamp column instead of firing it all at once")
+	flag.Var(&outputFile, "output-file", "append accepted datapoints to a rotating file (repeatable)")
+	flag.BoolVar(&outputStdout, "output-stdout", false, "print every accepted datapoint to stdout")
+	flag.BoolVar(&outputNull, "output-null", false, "discard every accepted datapoint (useful for benchmarking)")
+}
+
+// buildPlugins turns the parsed CLI flags into concrete Input/Output
+// plugins. When no -input-* flag is given at all, it falls back to the
+// classic UDP listener driven by config.json so existing deployments keep
+// working untouched.
+func buildPlugins() (ins []Input, outs []Output) {
+	for _, addr := range inputUDP {
+		if inputUDPWorkers > 1 {
+			workers, err := newUDPInputReusePort(addr, inputUDPWorkers)
+			mustPlugin(err)
+			ins = append(ins, workers...)
+			continue
+		}
+		in, err := newUDPInput(addr)
+		mustPlugin(err)
+		ins = append(ins, in)
+	}
+	for _, addr := range inputTCP {
+		in, err := newTCPInput(addr)
+		mustPlugin(err)
+		ins = append(ins, in)
+	}
+	for _, addr := range inputHTTP {
+		in, err := newHTTPInput(addr)
+		mustPlugin(err)
+		ins = append(ins, in)
+	}
+	for _, path := range inputReplay {
+		in, err := newReplayInput(path, replayPaced)
+		mustPlugin(err)
+		ins = append(ins, in)
+	}
+	if len(ins) == 0 {
+		in, err := newUDPInput(fmt.Sprintf("%s:%d", config.ReceiveIP, config.ReceivePort))
+		mustPlugin(err)
+		ins = append(ins, in)
+	}
+
+	for _, path := range outputFile {
+		out, err := newFileOutput(path)
+		mustPlugin(err)
+		outs = append(outs, out)
+	}
+	if outputStdout {
+		outs = append(outs, stdoutOutput{})
+	}
+	if outputNull {
+		outs = append(outs, nullOutput{})
+	}
+	return
+}
+
+func mustPlugin(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
@@ -2,15 +2,17 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"html/template"
 	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -39,6 +41,22 @@ type Config struct {
 	HttpPort int
 	// configs of different flows
 	Flows flowsConfig
+	// compression factor for the per-second t-digests backing percentile
+	// queries; higher is more accurate and uses more memory (~1-2KB per
+	// bucket at the default of 100). 0 means "use the default".
+	TDigestCompression float64
+	// downstream sinks that mirror every accepted datapoint; empty means
+	// the subscriptions subsystem is entirely disabled
+	Subscriptions []SubscriptionConfig
+	// Prometheus /metrics exposition settings
+	Metrics MetricsConfig
+}
+
+// MetricsConfig configures the /metrics Prometheus exposition endpoint.
+type MetricsConfig struct {
+	// moving-average windows (in seconds) to export per flow; defaults to
+	// 10/60/300 when left empty
+	Windows []uint
 }
 
 var config Config
@@ -52,38 +70,164 @@ const defaultConfig = `{
     "flows": {
         "_implicitCreate": true,
         "_defaultExpire": 86400
-    }
+    },
+    "tDigestCompression": 100
 }`
 
 type datapointsGroup struct {
+	// count/sum back the counter type and MovingAverage (addData/addTimer
+	// update them directly, alongside digest, for plain/timer flows) -
+	// count is also what marks a bucket as "has data" for the timer
+	// min/max logic.
 	count uint
 	sum   float64
+
+	// digest is a per-second t-digest sketch backing plain and timer
+	// flows: it answers arbitrary percentile queries without keeping raw
+	// samples. Lazily allocated, nil until the first sample lands in this
+	// bucket.
+	digest *tdigest
+
+	// gauge: last-value semantics, carried forward across empty seconds by
+	// advanceHead for flows whose metricType is metricGauge
+	gauge float64
+
+	// timer/histogram: min/max need their own fields; count/sum come from
+	// the fields above and percentiles from digest
+	timerMin float64
+	timerMax float64
+
+	// set: deduped unique values seen this second
+	set map[string]struct{}
 }
 
 // flowData type is supposed to be used as a ring buffer.
 // data stored in datapoints array, head is an active index in that array, capacity is array size.
 type flowData struct {
+	// mu guards every field below against the concurrent advanceHead
+	// (ticker goroutine), addData/addCounter/... (input goroutines) and
+	// NLastPoints (HTTP handler goroutine) calls that all touch the same
+	// flowData.
+	mu         sync.RWMutex
 	datapoints []datapointsGroup
 	head       uint
 	capacity   uint
+	// metricType is metricPlain unless the flow was created by a StatsD
+	// counter/gauge/timer/set line. StatsD lines are stored via the
+	// addCounter/addGauge/addTimer/addSetMember matching the line's own
+	// type, and "name value" lines via addData, whatever metricType is.
+	metricType metricType
+
+	// totalCount/totalSum accumulate across the flow's whole lifetime,
+	// unlike the per-second buckets which age out of the ring buffer; they
+	// back the /metrics flowmeter_flow_count_total/flowmeter_flow_sum
+	// counters.
+	totalCount uint64
+	totalSum   float64
 }
 
-// here we will store incoming flow datapoints
-// keys are strings; values are pointers to flowData structs
+// here we will store incoming flow datapoints; keys are strings, values are
+// pointers to flowData structs. flowMapMutex guards the map itself (so
+// implicit flow creation can't race the ticker's range over it); it does
+// not protect the flowData values, which guard themselves with their own
+// mu.
 var flowMap = map[string]*flowData{}
+var flowMapMutex sync.RWMutex
 
 func (fm *flowData) advanceHead() {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	previousGauge := fm.datapoints[fm.head].gauge
 	fm.head = (fm.head + 1) % fm.capacity
 	// clear previous values in now active index
 	fm.datapoints[fm.head] = datapointsGroup{}
+	if fm.metricType == metricGauge {
+		// gauges retain their last value until explicitly changed, even
+		// across seconds that saw no new datapoint
+		fm.datapoints[fm.head].gauge = previousGauge
+	}
 }
 
 func (fm *flowData) addData(point float64) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	bucket := &fm.datapoints[fm.head]
+	if bucket.digest == nil {
+		bucket.digest = newTDigest(config.TDigestCompression)
+	}
+	bucket.digest.addData(point)
+	bucket.count++
+	bucket.sum += point
+	fm.totalCount++
+	fm.totalSum += point
+}
+
+// addCounter records a StatsD counter sample, scaling it by 1/sampleRate so
+// sampled traffic still reports an accurate rate.
+func (fm *flowData) addCounter(value float64, sampleRate float64) {
+	if sampleRate <= 0 {
+		sampleRate = 1
+	}
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	scaled := value / sampleRate
 	fm.datapoints[fm.head].count++
-	fm.datapoints[fm.head].sum += point
+	fm.datapoints[fm.head].sum += scaled
+	fm.totalCount++
+	fm.totalSum += scaled
+}
+
+// addGauge records a StatsD gauge sample: an absolute value, or a delta
+// when delta is true (StatsD's "g:+10"/"g:-10" form).
+func (fm *flowData) addGauge(value float64, delta bool) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	point := &fm.datapoints[fm.head]
+	if delta {
+		point.gauge += value
+	} else {
+		point.gauge = value
+	}
+	point.count++
+}
+
+// addTimer records a StatsD timer/histogram sample.
+func (fm *flowData) addTimer(value float64) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	point := &fm.datapoints[fm.head]
+	if point.count == 0 || value < point.timerMin {
+		point.timerMin = value
+	}
+	if point.count == 0 || value > point.timerMax {
+		point.timerMax = value
+	}
+	if point.digest == nil {
+		point.digest = newTDigest(config.TDigestCompression)
+	}
+	point.digest.addData(value)
+	point.count++
+	point.sum += value
+	fm.totalCount++
+	fm.totalSum += value
+}
+
+// addSetMember records one member of a StatsD set; cardinality for a given
+// window is the size of the union of each second's set.
+func (fm *flowData) addSetMember(member string) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	point := &fm.datapoints[fm.head]
+	if point.set == nil {
+		point.set = make(map[string]struct{})
+	}
+	point.set[member] = struct{}{}
 }
 
 func (fm *flowData) NLastPoints(n uint) (points []datapointsGroup) {
+	fm.mu.RLock()
+	defer fm.mu.RUnlock()
+
 	// we could get no more points than there is
 	if n > fm.capacity {
 		n = fm.capacity
@@ -102,6 +246,20 @@ func (fm *flowData) NLastPoints(n uint) (points []datapointsGroup) {
 		//  negative numbers with same results... Keewl. But not in Go. "Go Perl!" ;))
 		index := (fm.capacity + fm.head - i) % fm.capacity
 		points[i] = fm.datapoints[index]
+		// the shallow copy above still shares the *tdigest pointer and the
+		// set map with the live bucket, which addData/addTimer/addSetMember
+		// keep mutating after we release fm.mu below; copy them so callers
+		// can merge/read them afterwards without racing that mutation.
+		if points[i].digest != nil {
+			points[i].digest = points[i].digest.clone()
+		}
+		if points[i].set != nil {
+			set := make(map[string]struct{}, len(points[i].set))
+			for member := range points[i].set {
+				set[member] = struct{}{}
+			}
+			points[i].set = set
+		}
 	}
 	return
 }
@@ -121,14 +279,82 @@ func (fm *flowData) MovingAverage(n uint) (average float64) {
 	return
 }
 
-func initFlow(name string, expire uint) {
+// Totals reports the flow's lifetime count and sum, unaffected by the
+// per-second ring buffer aging data out.
+func (fm *flowData) Totals() (count uint64, sum float64) {
+	fm.mu.RLock()
+	defer fm.mu.RUnlock()
+	return fm.totalCount, fm.totalSum
+}
+
+// MetricType reports the flow's StatsD metric type, recordStatsd's only
+// writer of which runs concurrently with any number of readers.
+func (fm *flowData) MetricType() metricType {
+	fm.mu.RLock()
+	defer fm.mu.RUnlock()
+	return fm.metricType
+}
+
+// Percentile merges the per-second t-digests of the last n seconds into
+// one and answers a q in [0,1] quantile query over that window, e.g.
+// q=0.99 for p99.
+func (fm *flowData) Percentile(n uint, q float64) float64 {
+	points := fm.NLastPoints(n)
+	merged := newTDigest(config.TDigestCompression)
+	for _, point := range points {
+		merged.merge(point.digest)
+	}
+	return merged.quantile(q)
+}
+
+func newFlowData(expire uint) *flowData {
 	capacity := config.Flows.DefaultExpire
 	if expire > 0 {
 		capacity = expire
 	}
-	flowMap[name] = &flowData{datapoints: make([]datapointsGroup, capacity), head: 0, capacity: capacity}
+	return &flowData{datapoints: make([]datapointsGroup, capacity), head: 0, capacity: capacity}
+}
+
+func initFlow(name string, expire uint) {
+	fm := newFlowData(expire)
+	flowMapMutex.Lock()
+	flowMap[name] = fm
+	flowMapMutex.Unlock()
 }
 
+// lookupFlow returns the named flow, implicitly creating it (honoring
+// config.Flows.ImplicitCreate) if it doesn't exist yet. created reports
+// whether this call just made it, so callers that need to initialize
+// type-specific fields (e.g. a StatsD metricType) only do so once. Safe to
+// call concurrently from any input goroutine.
+func lookupFlow(name string) (fm *flowData, created bool) {
+	flowMapMutex.RLock()
+	fm, exists := flowMap[name]
+	flowMapMutex.RUnlock()
+	if exists {
+		return fm, false
+	}
+	if !config.Flows.ImplicitCreate {
+		return nil, false
+	}
+
+	flowMapMutex.Lock()
+	defer flowMapMutex.Unlock()
+	// another goroutine may have created it while we were waiting for the write lock
+	if fm, exists = flowMap[name]; exists {
+		return fm, false
+	}
+	logger.Printf("received unknown flow [%s], implicitly adding to storage with expire [%d] seconds", name, config.Flows.DefaultExpire)
+	fm = newFlowData(0) // 0 means `use default expire value`
+	flowMap[name] = fm
+	atomic.AddUint64(&metricImplicitCreations, 1)
+	return fm, true
+}
+
+// metricImplicitCreations counts flows implicitly created because they
+// were unknown; exposed on /metrics as flowmeter_implicit_creations_total.
+var metricImplicitCreations uint64
+
 var timeTicker <-chan time.Time
 
 func init() {
@@ -152,6 +378,9 @@ func init() {
 		os.Exit(1)
 	}
 	//fmt.Printf("parsed config: %+v\n", config)
+	if config.TDigestCompression <= 0 {
+		config.TDigestCompression = defaultCompression
+	}
 
 	// setup logger
 	mypath := strings.Split(os.Args[0], "/")
@@ -181,10 +410,12 @@ func init() {
 	go func() {
 		for _ = range timeTicker {
 			//fmt.Println("Tick at", t)
+			flowMapMutex.RLock()
 			for _, fm := range flowMap {
 				fm.advanceHead()
 				//fmt.Printf("%+v\n\n", fm)
 			}
+			flowMapMutex.RUnlock()
 		}
 	}()
 }
@@ -194,27 +425,21 @@ var chttp = http.NewServeMux()
 func main() {
 	logger.Print("flowmeter starting...")
 
-	// bind to ports
-	// data receiver
-	udpConn, err := net.ListenUDP(
-		"udp",
-		&(net.UDPAddr{
-			IP:   net.ParseIP(config.ReceiveIP),
-			Port: config.ReceivePort,
-		}),
-	)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "can't bind to udp port [%v]: %v\n", config.ReceivePort, err)
-		os.Exit(1)
+	// bind inputs/outputs
+	// CLI flags (--input-udp, --input-tcp, --input-http, --input-replay,
+	// --output-file, --output-stdout, --output-null) pick the I/O topology;
+	// with none given we fall back to the classic config.json UDP listener.
+	flag.Parse()
+	inputs, outputs = buildPlugins()
+	for _, input := range inputs {
+		// one goroutine per input so they can all feed the emitter concurrently
+		go runInput(input)
 	}
-	defer udpConn.Close()
-	logger.Printf("listening udp on %s:%d", config.ReceiveIP, config.ReceivePort)
-	// wrap infinite loop into func and send it to goroutine to be able to also listen http port
-	go func() {
-		for {
-			receiveData(udpConn)
-		}
-	}()
+
+	// subscriptions mirror every accepted datapoint to downstream sinks;
+	// an empty config.Subscriptions makes this whole subsystem a no-op
+	subscriptions = buildSubscriptions()
+
 	// requests server (HTTP)
 	// without wrapping in goroutine, http.ListenAndServe block unless there are error, so I can't log about listening http
 	go func() {
@@ -224,7 +449,11 @@ func main() {
 		chttp.Handle("/", http.FileServer(http.Dir("./public/")))
 		// flow requests
 		http.HandleFunc("/meter", httpMeter)
-		err = http.ListenAndServe(config.HttpIP+":"+fmt.Sprintf("%d", config.HttpPort), nil)
+		// subscription sink drop counters
+		http.HandleFunc("/status", httpSubscriptionStatus)
+		// Prometheus/OpenMetrics scrape endpoint
+		http.HandleFunc("/metrics", httpMetrics)
+		err := http.ListenAndServe(config.HttpIP+":"+fmt.Sprintf("%d", config.HttpPort), nil)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "can't start http server: %v\n", err)
 			os.Exit(1)
@@ -234,57 +463,22 @@ func main() {
 
 	// manual blocking to prevent program from immediately ending
 	select {}
-
-	logger.Print("flowmeter stopped")
 }
 
-func receiveData(conn *net.UDPConn) {
-	// 3 seconds read timeout. Any Read call after given time will return with error.
-	// FIX: we shouldn't use timeout for network daemons, we should block until some data arrives
-	//conn.SetReadDeadline(time.Now().Add(3 * time.Second))
-
-	const maxPayload = 512 // max payload size. UDP by itself allows packets up to 64k bytes
-	var payload [maxPayload + 1]byte
-	n, err := conn.Read(payload[0:])
-	if err != nil {
-		logger.Printf("udp read error: %v", err)
-		return
-	}
-	if n > maxPayload {
-		logger.Printf("payload [%v] longer than max payload size [%d], rejecting", string(payload[0:n]), maxPayload)
-		return
-	}
-
-	data := strings.SplitN(string(payload[0:n]), " ", 2)
-	if len(data) < 2 {
-		logger.Printf("broken udp payload [%s]", string(payload[0:n]))
-		return
-	}
-	flowName := data[0]
-	value, err := strconv.ParseFloat(data[1], 64)
-	if err != nil {
-		logger.Printf("can't parse value [%s] into float64: %v", data[1], err)
-		return
-	}
-
-	//logger.Printf("received value [%.3f] for flow [%s]", value, flowName)
-
-	if _, exists := flowMap[flowName]; exists {
-		// ok
-	} else if config.Flows.ImplicitCreate {
-		logger.Printf("received unknown flow [%s], implicitly adding to storage with expire [%d] seconds", flowName, config.Flows.DefaultExpire)
-		initFlow(flowName, 0) // 0 means `use default expire value`
-	} else {
+// recordDatapoint stores a single datapoint in flowMap (implicitly creating
+// the flow if configured to do so) and fans it out to every registered
+// Output.
+func recordDatapoint(flowName string, value float64, ts time.Time) {
+	fm, _ := lookupFlow(flowName)
+	if fm == nil {
 		logger.Printf("can't store data: flow [%s] is unknown and implicit flow creation is disabled", flowName)
 		return
 	}
 
-	// proceed adding data
-	fm := flowMap[flowName]
 	fm.addData(value)
 
-	// disable timeout
-	//conn.SetReadDeadline(time.Time{})
+	emit(flowName, value, ts)
+	publish(flowName, value, ts)
 }
 
 func httpStatus(writer http.ResponseWriter, req *http.Request) {
@@ -431,19 +625,39 @@ func httpMeter(writer http.ResponseWriter, req *http.Request) {
 	}
 	window := uint(win)
 
-	if fm, exists := flowMap[flowName]; exists {
-		average := fm.MovingAverage(window)
-		templateData.Success = true
-		templateData.Data = struct {
-			Error    string
-			Average  float64
-			FlowName string
-			Window   uint
-		}{"", average, flowName, window}
-		logger.Printf("%+v", templateData.Data)
+	flowMapMutex.RLock()
+	fm, exists := flowMap[flowName]
+	flowMapMutex.RUnlock()
+	if !exists {
+		templateData.Data = struct{ Error string }{"unknown flow"}
+		return
+	}
+
+	if typeValue := req.FormValue("type"); len(typeValue) > 0 {
+		wantType, known := metricTypeFromString(typeValue)
+		if !known {
+			templateData.Data = struct{ Error string }{fmt.Sprintf("unknown type [%s]", typeValue)}
+			return
+		}
+		if wantType != fm.MetricType() {
+			templateData.Data = struct{ Error string }{fmt.Sprintf("flow [%s] is not of type [%s]", flowName, typeValue)}
+			return
+		}
+	}
+
+	average, err := fm.statValue(req.FormValue("stat"), window)
+	if err != nil {
+		templateData.Data = struct{ Error string }{err.Error()}
 		return
 	}
 
-	templateData.Data = struct{ Error string }{"unknown flow"}
+	templateData.Success = true
+	templateData.Data = struct {
+		Error    string
+		Average  float64
+		FlowName string
+		Window   uint
+	}{"", average, flowName, window}
+	logger.Printf("%+v", templateData.Data)
 	return
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// BenchmarkConcurrentIngestion stresses the same goroutines real traffic
+// would: many writers hammering addData/advanceHead across 1k flows while
+// readers poll NLastPoints, the way the ticker and /meter handler do. Run
+// with -race to confirm flowMap and flowData stay data-race free:
+//
+//	go test -bench=ConcurrentIngestion -race ./...
+func BenchmarkConcurrentIngestion(b *testing.B) {
+	const flowCount = 1000
+	names := make([]string, flowCount)
+	for i := range names {
+		name := fmt.Sprintf("flow-%d", i)
+		names[i] = name
+		initFlow(name, 60)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	// ticker goroutine: advances every flow's head, same as production
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				flowMapMutex.RLock()
+				for _, fm := range flowMap {
+					fm.advanceHead()
+				}
+				flowMapMutex.RUnlock()
+			}
+		}
+	}()
+
+	// reader goroutines: simulate HTTP clients polling /meter
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(1))
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					flowMapMutex.RLock()
+					fm := flowMap[names[rnd.Intn(flowCount)]]
+					flowMapMutex.RUnlock()
+					fm.MovingAverage(10)
+				}
+			}
+		}()
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	// writer goroutines: simulate input goroutines recording b.N datapoints,
+	// unthrottled, spread over the pool
+	var writers sync.WaitGroup
+	perWriter := b.N / 8
+	if perWriter == 0 {
+		perWriter = 1
+	}
+	for w := 0; w < 8; w++ {
+		writers.Add(1)
+		go func(seed int64) {
+			defer writers.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for i := 0; i < perWriter; i++ {
+				flowName := names[rnd.Intn(flowCount)]
+				recordDatapoint(flowName, rnd.Float64()*1000, time.Now())
+			}
+		}(int64(w))
+	}
+	writers.Wait()
+
+	close(stop)
+	wg.Wait()
+}
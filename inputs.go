@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// udpInput is the original text-protocol UDP listener: each packet is one
+// "name value" (or StatsD) payload.
+type udpInput struct {
+	conn *net.UDPConn
+}
+
+func newUDPInput(addr string) (*udpInput, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("can't resolve udp address [%s]: %v", addr, err)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("can't bind to udp address [%s]: %v", addr, err)
+	}
+	logger.Printf("listening udp on %s", addr)
+	return &udpInput{conn: conn}, nil
+}
+
+func (in *udpInput) Read(p []byte) (n int, meta Meta, err error) {
+	n, err = in.conn.Read(p)
+	return
+}
+
+// linePlugin is the shared machinery behind tcpInput and httpInput: both
+// accept payloads asynchronously (from any number of concurrent
+// connections/requests) and feed them through a channel so Read can stay a
+// simple blocking call.
+type linePlugin struct {
+	lines chan []byte
+}
+
+func newLinePlugin() *linePlugin {
+	return &linePlugin{lines: make(chan []byte, 1024)}
+}
+
+func (lp *linePlugin) Read(p []byte) (n int, meta Meta, err error) {
+	n = copy(p, <-lp.lines)
+	return
+}
+
+// tcpInput accepts TCP connections and treats every newline-terminated
+// line as one payload, same format as the UDP listener.
+type tcpInput struct {
+	*linePlugin
+	listener net.Listener
+}
+
+func newTCPInput(addr string) (*tcpInput, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("can't bind to tcp address [%s]: %v", addr, err)
+	}
+	logger.Printf("listening tcp on %s", addr)
+	in := &tcpInput{linePlugin: newLinePlugin(), listener: listener}
+	go in.accept()
+	return in, nil
+}
+
+func (in *tcpInput) accept() {
+	for {
+		conn, err := in.listener.Accept()
+		if err != nil {
+			logger.Printf("tcp accept error: %v", err)
+			continue
+		}
+		go in.readLines(conn)
+	}
+}
+
+func (in *tcpInput) readLines(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := make([]byte, len(scanner.Bytes()))
+		copy(line, scanner.Bytes())
+		in.lines <- line
+	}
+}
+
+// httpInput exposes a POST endpoint where the body is one payload per
+// line, same format as the UDP listener.
+type httpInput struct {
+	*linePlugin
+}
+
+func newHTTPInput(addr string) (*httpInput, error) {
+	in := &httpInput{linePlugin: newLinePlugin()}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", in.handle)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			fmt.Fprintf(os.Stderr, "can't start http input on [%s]: %v\n", addr, err)
+			os.Exit(1)
+		}
+	}()
+	logger.Printf("listening http input on %s", addr)
+	return in, nil
+}
+
+func (in *httpInput) handle(writer http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	scanner := bufio.NewScanner(req.Body)
+	for scanner.Scan() {
+		line := make([]byte, len(scanner.Bytes()))
+		copy(line, scanner.Bytes())
+		in.lines <- line
+	}
+}
+
+// replayInput replays payloads from stdin or a file, one per line,
+// optionally pacing them out according to a leading unix-timestamp column
+// ("<unixtime> name value") instead of firing them all at once.
+type replayInput struct {
+	scanner *bufio.Scanner
+	paced   bool
+	lastTs  time.Time
+}
+
+func newReplayInput(path string, paced bool) (*replayInput, error) {
+	file := os.Stdin
+	if path != "-" && path != "" {
+		var err error
+		file, err = os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("can't open replay file [%s]: %v", path, err)
+		}
+	}
+	return &replayInput{scanner: bufio.NewScanner(file), paced: paced}, nil
+}
+
+// Read returns io.EOF, following the io.Reader convention, once the
+// underlying scanner is exhausted; runInput treats that as "this input is
+// done" and stops pumping it instead of busy-looping on a permanent error.
+func (in *replayInput) Read(p []byte) (n int, meta Meta, err error) {
+	if !in.scanner.Scan() {
+		if err = in.scanner.Err(); err == nil {
+			err = io.EOF
+		}
+		return
+	}
+	line := in.scanner.Bytes()
+	if in.paced {
+		if parts := strings.SplitN(string(line), " ", 2); len(parts) == 2 {
+			if unixTs, perr := strconv.ParseInt(parts[0], 10, 64); perr == nil {
+				ts := time.Unix(unixTs, 0)
+				if !in.lastTs.IsZero() {
+					if d := ts.Sub(in.lastTs); d > 0 {
+						time.Sleep(d)
+					}
+				}
+				in.lastTs = ts
+				line = []byte(parts[1])
+				meta.Timestamp = ts
+			}
+		}
+	}
+	n = copy(p, line)
+	return
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+// defaultMetricsWindows is used whenever config.Metrics.Windows is empty.
+var defaultMetricsWindows = []uint{10, 60, 300}
+
+// httpMetrics renders every flow in flowMap, plus internal ingestion
+// counters, as a Prometheus/OpenMetrics text exposition so Prometheus,
+// Grafana Agent or VictoriaMetrics can scrape flowmeter directly.
+func httpMetrics(writer http.ResponseWriter, req *http.Request) {
+	windows := config.Metrics.Windows
+	if len(windows) == 0 {
+		windows = defaultMetricsWindows
+	}
+
+	flowMapMutex.RLock()
+	flows := make(map[string]*flowData, len(flowMap))
+	names := make([]string, 0, len(flowMap))
+	for name, fm := range flowMap {
+		flows[name] = fm
+		names = append(names, name)
+	}
+	flowMapMutex.RUnlock()
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+
+	buf.WriteString("# HELP flowmeter_flow_average Moving average of a flow's values over the given window.\n")
+	buf.WriteString("# TYPE flowmeter_flow_average gauge\n")
+	for _, name := range names {
+		fm := flows[name]
+		for _, window := range windows {
+			fmt.Fprintf(&buf, "flowmeter_flow_average{flow=%q,window=\"%d\"} %v\n", name, window, fm.MovingAverage(window))
+		}
+	}
+
+	buf.WriteString("# HELP flowmeter_flow_count_total Datapoints recorded for a flow since it was created; gauge and set samples are not counted.\n")
+	buf.WriteString("# TYPE flowmeter_flow_count_total counter\n")
+	buf.WriteString("# HELP flowmeter_flow_sum Sum of values recorded for a flow since it was created; gauge and set samples are not included.\n")
+	buf.WriteString("# TYPE flowmeter_flow_sum counter\n")
+	for _, name := range names {
+		count, sum := flows[name].Totals()
+		fmt.Fprintf(&buf, "flowmeter_flow_count_total{flow=%q} %d\n", name, count)
+		fmt.Fprintf(&buf, "flowmeter_flow_sum{flow=%q} %v\n", name, sum)
+	}
+
+	buf.WriteString("# HELP flowmeter_packets_received_total Payloads successfully read across all inputs.\n")
+	buf.WriteString("# TYPE flowmeter_packets_received_total counter\n")
+	fmt.Fprintf(&buf, "flowmeter_packets_received_total %d\n", atomic.LoadUint64(&metricPacketsReceived))
+
+	buf.WriteString("# HELP flowmeter_parse_errors_total Payloads that failed to parse.\n")
+	buf.WriteString("# TYPE flowmeter_parse_errors_total counter\n")
+	fmt.Fprintf(&buf, "flowmeter_parse_errors_total %d\n", atomic.LoadUint64(&metricParseErrors))
+
+	buf.WriteString("# HELP flowmeter_implicit_creations_total Flows implicitly created because they were unknown.\n")
+	buf.WriteString("# TYPE flowmeter_implicit_creations_total counter\n")
+	fmt.Fprintf(&buf, "flowmeter_implicit_creations_total %d\n", atomic.LoadUint64(&metricImplicitCreations))
+
+	buf.WriteString("# HELP flowmeter_sink_drops_total Datapoints dropped because a subscription sink's queue was full.\n")
+	buf.WriteString("# TYPE flowmeter_sink_drops_total counter\n")
+	for _, sub := range subscriptions {
+		for i, w := range sub.workers {
+			fmt.Fprintf(&buf, "flowmeter_sink_drops_total{subscription=%q,destination=\"destination-%d\"} %d\n", sub.name, i, atomic.LoadUint64(&w.dropped))
+		}
+	}
+
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writer.Write(buf.Bytes())
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHTTPMetricsFormat exercises httpMetrics end to end against a couple
+// of flows and checks the Prometheus/OpenMetrics exposition it renders
+// carries the expected HELP/TYPE lines and per-flow series, the output
+// every request's chunk0-2..chunk0-6 aggregation logic ultimately feeds.
+func TestHTTPMetricsFormat(t *testing.T) {
+	defer swapFlowMap(map[string]*flowData{})()
+	defer swapMetricsWindows([]uint{10})()
+
+	initFlow("cpu", 60)
+	recordDatapoint("cpu", 1, time.Unix(1, 0))
+	recordDatapoint("cpu", 3, time.Unix(2, 0))
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	httpMetrics(rec, req)
+
+	resp := rec.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type = %q, want text/plain prefix", ct)
+	}
+
+	body := rec.Body.String()
+	wantSubstrings := []string{
+		"# HELP flowmeter_flow_average",
+		"# TYPE flowmeter_flow_average gauge",
+		`flowmeter_flow_average{flow="cpu",window="10"}`,
+		"# TYPE flowmeter_flow_count_total counter",
+		`flowmeter_flow_count_total{flow="cpu"} 2`,
+		`flowmeter_flow_sum{flow="cpu"} 4`,
+		"flowmeter_packets_received_total",
+		"flowmeter_parse_errors_total",
+		"flowmeter_implicit_creations_total",
+		"flowmeter_sink_drops_total",
+	}
+	for _, want := range wantSubstrings {
+		if !strings.Contains(body, want) {
+			t.Errorf("response body missing %q\nfull body:\n%s", want, body)
+		}
+	}
+}
+
+// TestHTTPMetricsDefaultWindows checks that an empty config.Metrics.Windows
+// falls back to defaultMetricsWindows rather than omitting the series.
+func TestHTTPMetricsDefaultWindows(t *testing.T) {
+	defer swapFlowMap(map[string]*flowData{})()
+	defer swapMetricsWindows(nil)()
+
+	initFlow("cpu", 60)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	httpMetrics(rec, req)
+
+	body := rec.Body.String()
+	for _, window := range defaultMetricsWindows {
+		want := `window="` + strconv.FormatUint(uint64(window), 10) + `"`
+		if !strings.Contains(body, want) {
+			t.Errorf("response body missing default window series %q\nfull body:\n%s", want, body)
+		}
+	}
+}
+
+// swapFlowMap replaces flowMap for the duration of a test and returns a
+// func that restores the previous one, since flowMap is shared package
+// state every test in this binary runs against.
+func swapFlowMap(next map[string]*flowData) func() {
+	flowMapMutex.Lock()
+	prev := flowMap
+	flowMap = next
+	flowMapMutex.Unlock()
+	return func() {
+		flowMapMutex.Lock()
+		flowMap = prev
+		flowMapMutex.Unlock()
+	}
+}
+
+func swapMetricsWindows(next []uint) func() {
+	prev := config.Metrics.Windows
+	config.Metrics.Windows = next
+	return func() {
+		config.Metrics.Windows = prev
+	}
+}
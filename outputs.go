@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// stdoutOutput writes every accepted datapoint to stdout, one line per
+// datapoint, as "<unixtime> name value" (the format -input-replay-paced
+// reads).
+type stdoutOutput struct{}
+
+func (stdoutOutput) Write(flow string, value float64, ts time.Time) {
+	fmt.Printf("%d %s %v\n", ts.Unix(), flow, value)
+}
+
+// nullOutput discards everything; useful for benchmarking the ingestion
+// path without the cost of an actual sink.
+type nullOutput struct{}
+
+func (nullOutput) Write(flow string, value float64, ts time.Time) {}
+
+// fileOutput appends datapoints to a file, rotating to a timestamped file
+// once the current one exceeds maxBytes. Write is reachable from every
+// input goroutine at once (UDP/TCP/HTTP, or several SO_REUSEPORT workers),
+// so mu guards file/written and serializes rotation.
+type fileOutput struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	file     *os.File
+	written  int64
+}
+
+const fileOutputMaxBytes = 100 * 1024 * 1024 // 100MB
+
+func newFileOutput(path string) (*fileOutput, error) {
+	out := &fileOutput{path: path, maxBytes: fileOutputMaxBytes}
+	if err := out.openCurrent(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (out *fileOutput) openCurrent() error {
+	file, err := os.OpenFile(out.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("can't open output file [%s]: %v", out.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("can't stat output file [%s]: %v", out.path, err)
+	}
+	out.file = file
+	out.written = info.Size()
+	return nil
+}
+
+func (out *fileOutput) rotate() {
+	out.file.Close()
+	rotated := fmt.Sprintf("%s.%d", out.path, time.Now().Unix())
+	if err := os.Rename(out.path, rotated); err != nil {
+		logger.Printf("can't rotate output file [%s]: %v", out.path, err)
+	}
+	if err := out.openCurrent(); err != nil {
+		logger.Printf("can't reopen output file [%s] after rotation: %v", out.path, err)
+	}
+}
+
+func (out *fileOutput) Write(flow string, value float64, ts time.Time) {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	if out.written >= out.maxBytes {
+		out.rotate()
+	}
+	line := fmt.Sprintf("%d %s %v\n", ts.Unix(), flow, value)
+	n, err := out.file.WriteString(line)
+	if err != nil {
+		logger.Printf("can't write to output file [%s]: %v", out.path, err)
+		return
+	}
+	out.written += int64(n)
+}
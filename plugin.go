@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Meta carries out-of-band information about a Read call that the emitter
+// needs but that doesn't belong in the raw payload itself, e.g. a replay
+// input restoring the original timestamp of a recorded line.
+type Meta struct {
+	// Timestamp is the point in time the payload should be attributed to.
+	// Zero means "use time.Now()".
+	Timestamp time.Time
+}
+
+// Input is a source of raw datapoint payloads. Read behaves like
+// io.Reader: it blocks until a payload is available, copies it into p and
+// returns its length, alongside any Meta the input wants to attach to it.
+type Input interface {
+	Read(p []byte) (n int, meta Meta, err error)
+}
+
+// Output receives every datapoint accepted into flowMap, in addition to
+// local storage, so it can be mirrored to stdout, a file, or further
+// downstream sinks.
+type Output interface {
+	Write(flow string, value float64, ts time.Time)
+}
+
+// inputs and outputs are populated once at startup by buildPlugins; the
+// emitter fans every accepted datapoint out to all of outputs.
+var inputs []Input
+var outputs []Output
+
+// internal counters exposed on /metrics as flowmeter_packets_received_total
+// and flowmeter_parse_errors_total.
+var metricPacketsReceived uint64
+var metricParseErrors uint64
+
+// emit fans an accepted datapoint out to every registered Output.
+func emit(flow string, value float64, ts time.Time) {
+	for _, output := range outputs {
+		output.Write(flow, value, ts)
+	}
+}
+
+// runInput pumps one Input until it returns io.EOF: read a payload, parse
+// it, record it.
+func runInput(input Input) {
+	const maxPayload = 512 // max payload size. UDP by itself allows packets up to 64k bytes
+	var payload [maxPayload + 1]byte
+	for {
+		n, meta, err := input.Read(payload[0:])
+		if err == io.EOF {
+			logger.Printf("input exhausted, stopping")
+			return
+		}
+		if err != nil {
+			logger.Printf("input read error: %v", err)
+			continue
+		}
+		if n > maxPayload {
+			logger.Printf("payload [%v] longer than max payload size [%d], rejecting", string(payload[0:n]), maxPayload)
+			continue
+		}
+		atomic.AddUint64(&metricPacketsReceived, 1)
+
+		ts := meta.Timestamp
+		if ts.IsZero() {
+			ts = time.Now()
+		}
+
+		raw := payload[0:n]
+		if looksLikeStatsd(raw) {
+			metric, err := parseStatsdPayload(raw)
+			if err != nil {
+				atomic.AddUint64(&metricParseErrors, 1)
+				logger.Printf("%v", err)
+				continue
+			}
+			recordStatsd(metric, ts)
+			continue
+		}
+
+		flowName, value, err := parseTextPayload(raw)
+		if err != nil {
+			atomic.AddUint64(&metricParseErrors, 1)
+			logger.Printf("%v", err)
+			continue
+		}
+		recordDatapoint(flowName, value, ts)
+	}
+}
+
+// parseTextPayload parses the current "name value" text protocol shared by
+// all first-party inputs.
+func parseTextPayload(payload []byte) (flowName string, value float64, err error) {
+	data := strings.SplitN(string(payload), " ", 2)
+	if len(data) < 2 {
+		err = fmt.Errorf("broken payload [%s]", string(payload))
+		return
+	}
+	flowName = data[0]
+	value, err = strconv.ParseFloat(data[1], 64)
+	if err != nil {
+		err = fmt.Errorf("can't parse value [%s] into float64: %v", data[1], err)
+	}
+	return
+}
@@ -0,0 +1,56 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// newUDPInputReusePort binds `workers` independent UDP sockets to the same
+// address using SO_REUSEPORT, letting the kernel load-balance incoming
+// packets across them so multiple cores can receive in parallel instead of
+// funneling every packet through one goroutine's Read loop.
+func newUDPInputReusePort(addr string, workers int) ([]Input, error) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			}); err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+
+	ins := make([]Input, 0, workers)
+	for i := 0; i < workers; i++ {
+		conn, err := lc.ListenPacket(context.Background(), "udp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("can't bind SO_REUSEPORT udp worker %d on [%s]: %v", i, addr, err)
+		}
+		logger.Printf("listening udp (SO_REUSEPORT worker %d/%d) on %s", i+1, workers, addr)
+		ins = append(ins, &udpPacketInput{conn: conn})
+	}
+	return ins, nil
+}
+
+// udpPacketInput adapts a net.PacketConn (used for SO_REUSEPORT workers) to
+// the Input interface.
+type udpPacketInput struct {
+	conn net.PacketConn
+}
+
+func (in *udpPacketInput) Read(p []byte) (n int, meta Meta, err error) {
+	n, _, err = in.conn.ReadFrom(p)
+	return
+}
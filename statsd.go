@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metricType distinguishes the aggregation a flow's datapoints need: the
+// original plain count/sum, or one of the StatsD types.
+type metricType int
+
+const (
+	metricPlain metricType = iota
+	metricCounter
+	metricGauge
+	metricTimer
+	metricSet
+)
+
+// statsdMetric is one parsed StatsD line: "name:value|type[|@sampleRate]".
+type statsdMetric struct {
+	name       string
+	mtype      metricType
+	value      float64
+	gaugeDelta bool // true if value carries an explicit +/- sign (gauge delta)
+	setMember  string
+	sampleRate float64
+}
+
+// looksLikeStatsd sniffs whether a payload is StatsD's "name:value|type"
+// line protocol rather than the original "name value" format.
+func looksLikeStatsd(payload []byte) bool {
+	return strings.Contains(string(payload), ":") && strings.Contains(string(payload), "|")
+}
+
+func parseStatsdPayload(payload []byte) (m statsdMetric, err error) {
+	line := string(payload)
+
+	nameValue := strings.SplitN(line, ":", 2)
+	if len(nameValue) != 2 {
+		err = fmt.Errorf("broken statsd payload [%s]", line)
+		return
+	}
+	m.name = nameValue[0]
+
+	fields := strings.Split(nameValue[1], "|")
+	if len(fields) < 2 {
+		err = fmt.Errorf("broken statsd payload [%s]", line)
+		return
+	}
+	valueField, typeField := fields[0], fields[1]
+
+	m.sampleRate = 1
+	for _, extra := range fields[2:] {
+		if !strings.HasPrefix(extra, "@") {
+			continue
+		}
+		if rate, rerr := strconv.ParseFloat(extra[1:], 64); rerr == nil && rate > 0 {
+			m.sampleRate = rate
+		}
+	}
+
+	switch typeField {
+	case "c":
+		m.mtype = metricCounter
+	case "g":
+		m.mtype = metricGauge
+		m.gaugeDelta = strings.HasPrefix(valueField, "+") || strings.HasPrefix(valueField, "-")
+	case "ms", "h":
+		m.mtype = metricTimer
+	case "s":
+		m.mtype = metricSet
+		m.setMember = valueField
+		return
+	default:
+		err = fmt.Errorf("unknown statsd type [%s] in payload [%s]", typeField, line)
+		return
+	}
+
+	m.value, err = strconv.ParseFloat(valueField, 64)
+	if err != nil {
+		err = fmt.Errorf("can't parse value [%s] into float64: %v", valueField, err)
+	}
+	return
+}
+
+// recordStatsd stores one parsed StatsD metric in flowMap (implicitly
+// creating the flow, typed to match, if configured to do so) and fans it
+// out to every registered Output.
+func recordStatsd(m statsdMetric, ts time.Time) {
+	fm, created := lookupFlow(m.name)
+	if fm == nil {
+		logger.Printf("can't store data: flow [%s] is unknown and implicit flow creation is disabled", m.name)
+		return
+	}
+	if created {
+		fm.mu.Lock()
+		fm.metricType = m.mtype
+		fm.mu.Unlock()
+	}
+
+	switch m.mtype {
+	case metricCounter:
+		fm.addCounter(m.value, m.sampleRate)
+	case metricGauge:
+		fm.addGauge(m.value, m.gaugeDelta)
+	case metricTimer:
+		fm.addTimer(m.value)
+	case metricSet:
+		fm.addSetMember(m.setMember)
+	}
+
+	emit(m.name, m.value, ts)
+	publish(m.name, m.value, ts)
+}
+
+// CounterRate reports the average per-second rate of a counter flow over
+// the last n seconds.
+func (fm *flowData) CounterRate(n uint) (rate float64) {
+	if n == 0 {
+		return 0
+	}
+	points := fm.NLastPoints(n)
+	var sum float64
+	for _, point := range points {
+		sum += point.sum
+	}
+	return sum / float64(n)
+}
+
+// GaugeValue reports the flow's current gauge value.
+func (fm *flowData) GaugeValue() float64 {
+	fm.mu.RLock()
+	defer fm.mu.RUnlock()
+	return fm.datapoints[fm.head].gauge
+}
+
+// TimerUpper reports the highest timer sample seen in the last n seconds.
+func (fm *flowData) TimerUpper(n uint) (upper float64) {
+	points := fm.NLastPoints(n)
+	seen := false
+	for _, point := range points {
+		if point.count == 0 {
+			continue
+		}
+		if !seen || point.timerMax > upper {
+			upper = point.timerMax
+			seen = true
+		}
+	}
+	return
+}
+
+// SetCardinality reports the number of distinct set members seen across
+// the last n seconds.
+func (fm *flowData) SetCardinality(n uint) uint {
+	points := fm.NLastPoints(n)
+	seen := make(map[string]struct{})
+	for _, point := range points {
+		for member := range point.set {
+			seen[member] = struct{}{}
+		}
+	}
+	return uint(len(seen))
+}
+
+// metricTypeFromString maps the /meter "type" query parameter to a
+// metricType; ok is false for an unrecognized value.
+func metricTypeFromString(s string) (mtype metricType, ok bool) {
+	switch s {
+	case "", "plain":
+		return metricPlain, true
+	case "counter":
+		return metricCounter, true
+	case "gauge":
+		return metricGauge, true
+	case "timer":
+		return metricTimer, true
+	case "set":
+		return metricSet, true
+	}
+	return metricPlain, false
+}
+
+// statValue answers a /meter query for one of the StatsD-flavoured stats,
+// a percentile (p50/p90/p95/p99/...), or the original moving average when
+// stat is empty.
+func (fm *flowData) statValue(stat string, window uint) (float64, error) {
+	switch stat {
+	case "", "average":
+		return fm.MovingAverage(window), nil
+	case "rate":
+		return fm.CounterRate(window), nil
+	case "gauge":
+		return fm.GaugeValue(), nil
+	case "upper":
+		return fm.TimerUpper(window), nil
+	case "unique":
+		return float64(fm.SetCardinality(window)), nil
+	}
+	if strings.HasPrefix(stat, "p") {
+		percentile, err := strconv.ParseFloat(stat[1:], 64)
+		if err == nil && percentile > 0 && percentile <= 100 {
+			return fm.Percentile(window, percentile/100), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown stat [%s]", stat)
+}
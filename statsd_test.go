@@ -0,0 +1,83 @@
+package main
+
+import "testing"
+
+func TestLooksLikeStatsd(t *testing.T) {
+	cases := []struct {
+		payload string
+		want    bool
+	}{
+		{"some.flow:1|c", true},
+		{"some.flow 1", false},
+		{"broken", false},
+	}
+	for _, c := range cases {
+		if got := looksLikeStatsd([]byte(c.payload)); got != c.want {
+			t.Errorf("looksLikeStatsd(%q) = %v, want %v", c.payload, got, c.want)
+		}
+	}
+}
+
+func TestParseStatsdPayload(t *testing.T) {
+	cases := []struct {
+		name    string
+		payload string
+		want    statsdMetric
+	}{
+		{
+			name:    "counter",
+			payload: "hits:1|c",
+			want:    statsdMetric{name: "hits", mtype: metricCounter, value: 1, sampleRate: 1},
+		},
+		{
+			name:    "counter with sample rate",
+			payload: "hits:1|c|@0.1",
+			want:    statsdMetric{name: "hits", mtype: metricCounter, value: 1, sampleRate: 0.1},
+		},
+		{
+			name:    "gauge absolute",
+			payload: "queue.size:42|g",
+			want:    statsdMetric{name: "queue.size", mtype: metricGauge, value: 42, sampleRate: 1},
+		},
+		{
+			name:    "gauge delta",
+			payload: "queue.size:-5|g",
+			want:    statsdMetric{name: "queue.size", mtype: metricGauge, value: -5, sampleRate: 1, gaugeDelta: true},
+		},
+		{
+			name:    "timer",
+			payload: "request.duration:123.4|ms",
+			want:    statsdMetric{name: "request.duration", mtype: metricTimer, value: 123.4, sampleRate: 1},
+		},
+		{
+			name:    "set",
+			payload: "unique.visitors:user42|s",
+			want:    statsdMetric{name: "unique.visitors", mtype: metricSet, setMember: "user42", sampleRate: 1},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := parseStatsdPayload([]byte(c.payload))
+			if err != nil {
+				t.Fatalf("parseStatsdPayload(%q) returned error: %v", c.payload, err)
+			}
+			if got != c.want {
+				t.Errorf("parseStatsdPayload(%q) = %+v, want %+v", c.payload, got, c.want)
+			}
+		})
+	}
+}
+
+func TestParseStatsdPayloadErrors(t *testing.T) {
+	cases := []string{
+		"no-colon-or-pipe",
+		"name:noPipe",
+		"name:1|unknowntype",
+		"name:notanumber|c",
+	}
+	for _, payload := range cases {
+		if _, err := parseStatsdPayload([]byte(payload)); err == nil {
+			t.Errorf("parseStatsdPayload(%q) expected an error, got nil", payload)
+		}
+	}
+}
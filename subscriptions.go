@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// SubscriptionConfig declares one named set of downstream sinks that should
+// receive every accepted datapoint, inspired by InfluxDB subscriptions.
+// Mode "ANY" round-robins across Destinations, "ALL" mirrors to all of
+// them. An empty Subscriptions list in Config is a no-op.
+type SubscriptionConfig struct {
+	Name         string
+	Mode         string
+	Destinations []string
+}
+
+// Sink is a downstream system that accepted datapoints are forwarded to.
+type Sink interface {
+	Send(flow string, value float64, ts time.Time)
+}
+
+// subscriptionMsg is one accepted datapoint queued for delivery to a
+// subscription's sinks.
+type subscriptionMsg struct {
+	flow  string
+	value float64
+	ts    time.Time
+}
+
+// sinkWorker owns one Sink and its own bounded channel, so a slow or down
+// destination can't block the others or the ingestion hot path.
+type sinkWorker struct {
+	sink    Sink
+	queue   chan subscriptionMsg
+	dropped uint64 // atomic
+}
+
+const sinkQueueSize = 1024
+
+func newSinkWorker(sink Sink) *sinkWorker {
+	w := &sinkWorker{sink: sink, queue: make(chan subscriptionMsg, sinkQueueSize)}
+	go w.run()
+	return w
+}
+
+func (w *sinkWorker) run() {
+	for msg := range w.queue {
+		w.sink.Send(msg.flow, msg.value, msg.ts)
+	}
+}
+
+// enqueue never blocks: when the worker's queue is full the message is
+// dropped and counted, so backpressure on one destination is visible on
+// /status instead of stalling ingestion.
+func (w *sinkWorker) enqueue(msg subscriptionMsg) {
+	select {
+	case w.queue <- msg:
+	default:
+		atomic.AddUint64(&w.dropped, 1)
+	}
+}
+
+// subscription fans datapoints out to its sinkWorkers according to Mode.
+type subscription struct {
+	name    string
+	mode    string
+	workers []*sinkWorker
+	next    uint64 // atomic round-robin cursor for ANY mode
+}
+
+func (s *subscription) dispatch(msg subscriptionMsg) {
+	if len(s.workers) == 0 {
+		return
+	}
+	if s.mode == "ALL" {
+		for _, w := range s.workers {
+			w.enqueue(msg)
+		}
+		return
+	}
+	// ANY: round-robin across destinations
+	i := atomic.AddUint64(&s.next, 1)
+	s.workers[i%uint64(len(s.workers))].enqueue(msg)
+}
+
+// subscriptions is built once at startup by buildSubscriptions; publish
+// fans every accepted datapoint out to all of them.
+var subscriptions []*subscription
+
+// buildSubscriptions turns config.Subscriptions into running subscriptions.
+// A destination that fails to parse aborts startup, same as a bad -input-*
+// flag, since a dangling subscription would silently swallow data.
+func buildSubscriptions() []*subscription {
+	subs := make([]*subscription, 0, len(config.Subscriptions))
+	for _, cfg := range config.Subscriptions {
+		mode := strings.ToUpper(cfg.Mode)
+		if mode != "ALL" {
+			mode = "ANY"
+		}
+		sub := &subscription{name: cfg.Name, mode: mode}
+		for _, destination := range cfg.Destinations {
+			sink, err := newSink(destination)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "can't build subscription [%s]: %v\n", cfg.Name, err)
+				os.Exit(1)
+			}
+			sub.workers = append(sub.workers, newSinkWorker(sink))
+		}
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// publish fans an accepted datapoint out to every subscription, each
+// non-blockingly enqueuing onto its own sinks' workers.
+func publish(flow string, value float64, ts time.Time) {
+	if len(subscriptions) == 0 {
+		return
+	}
+	msg := subscriptionMsg{flow: flow, value: value, ts: ts}
+	for _, sub := range subscriptions {
+		sub.dispatch(msg)
+	}
+}
+
+// httpSubscriptionStatus reports, per subscription and destination, how
+// many messages have been dropped because a sink's queue was full - the
+// only externally visible sign that a downstream sink is falling behind.
+func httpSubscriptionStatus(writer http.ResponseWriter, req *http.Request) {
+	status := make(map[string]map[string]uint64, len(subscriptions))
+	for _, sub := range subscriptions {
+		drops := make(map[string]uint64, len(sub.workers))
+		for i, w := range sub.workers {
+			drops[fmt.Sprintf("destination-%d", i)] = atomic.LoadUint64(&w.dropped)
+		}
+		status[sub.name] = drops
+	}
+
+	js, err := json.Marshal(status)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(js)
+}
+
+// newSink builds a Sink from a destination URL: "kafka://broker/topic" for
+// Kafka, an "http(s)://.../write..." path for InfluxDB line protocol, and
+// any other http(s) URL for generic JSON POSTs.
+func newSink(destination string) (Sink, error) {
+	u, err := url.Parse(destination)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse sink destination [%s]: %v", destination, err)
+	}
+	switch u.Scheme {
+	case "kafka":
+		return newKafkaSink(u)
+	case "http", "https":
+		if strings.Contains(u.Path, "/write") {
+			return newInfluxSink(destination), nil
+		}
+		return newHTTPJSONSink(destination), nil
+	}
+	return nil, fmt.Errorf("unknown sink scheme [%s] in destination [%s]", u.Scheme, destination)
+}
+
+const sinkHTTPTimeout = 5 * time.Second
+
+// influxSink writes datapoints as InfluxDB line protocol over HTTP.
+type influxSink struct {
+	url    string
+	client *http.Client
+}
+
+func newInfluxSink(rawURL string) *influxSink {
+	return &influxSink{url: rawURL, client: &http.Client{Timeout: sinkHTTPTimeout}}
+}
+
+func (s *influxSink) Send(flow string, value float64, ts time.Time) {
+	line := fmt.Sprintf("%s value=%v %d\n", flow, value, ts.UnixNano())
+	resp, err := s.client.Post(s.url, "text/plain", strings.NewReader(line))
+	if err != nil {
+		logger.Printf("influx sink [%s] write error: %v", s.url, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// httpJSONSink POSTs each datapoint as a standalone JSON object.
+type httpJSONSink struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPJSONSink(rawURL string) *httpJSONSink {
+	return &httpJSONSink{url: rawURL, client: &http.Client{Timeout: sinkHTTPTimeout}}
+}
+
+func (s *httpJSONSink) Send(flow string, value float64, ts time.Time) {
+	body, err := json.Marshal(struct {
+		Flow  string
+		Value float64
+		Ts    int64
+	}{flow, value, ts.Unix()})
+	if err != nil {
+		logger.Printf("http sink [%s] marshal error: %v", s.url, err)
+		return
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.Printf("http sink [%s] write error: %v", s.url, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// kafkaSink writes datapoints as JSON-valued Kafka messages.
+type kafkaSink struct {
+	writer *kafka.Writer
+}
+
+func newKafkaSink(u *url.URL) (*kafkaSink, error) {
+	topic := strings.TrimPrefix(u.Path, "/")
+	if topic == "" {
+		return nil, fmt.Errorf("kafka destination [%s] is missing a topic", u.String())
+	}
+	return &kafkaSink{writer: &kafka.Writer{
+		Addr:     kafka.TCP(u.Host),
+		Topic:    topic,
+		Balancer: &kafka.LeastBytes{},
+	}}, nil
+}
+
+func (s *kafkaSink) Send(flow string, value float64, ts time.Time) {
+	body, err := json.Marshal(struct {
+		Flow  string
+		Value float64
+		Ts    int64
+	}{flow, value, ts.Unix()})
+	if err != nil {
+		logger.Printf("kafka sink marshal error: %v", err)
+		return
+	}
+	if err := s.writer.WriteMessages(context.Background(), kafka.Message{Key: []byte(flow), Value: body}); err != nil {
+		logger.Printf("kafka sink write error: %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// recordingSink is a Sink that records every call it receives, guarded by
+// its own mutex since sinkWorker.run is the only thing that should call
+// Send but tests read the recorded calls from the main goroutine.
+type recordingSink struct {
+	mu    sync.Mutex
+	calls []subscriptionMsg
+}
+
+func (s *recordingSink) Send(flow string, value float64, ts time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, subscriptionMsg{flow: flow, value: value, ts: ts})
+}
+
+func (s *recordingSink) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.calls)
+}
+
+// waitForCalls polls until every sink has received n calls, or fails the
+// test after a short timeout - dispatch hands off to each sinkWorker's
+// queue asynchronously.
+func waitForCalls(t *testing.T, sinks []*recordingSink, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		done := true
+		for _, s := range sinks {
+			if s.len() != n {
+				done = false
+				break
+			}
+		}
+		if done {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("sinks did not receive %d calls in time", n)
+}
+
+func TestSubscriptionDispatchALL(t *testing.T) {
+	sinks := []*recordingSink{{}, {}, {}}
+	sub := &subscription{name: "all-sub", mode: "ALL"}
+	for _, s := range sinks {
+		sub.workers = append(sub.workers, newSinkWorker(s))
+	}
+
+	sub.dispatch(subscriptionMsg{flow: "cpu", value: 1, ts: time.Unix(1, 0)})
+	waitForCalls(t, sinks, 1)
+
+	for i, s := range sinks {
+		if s.calls[0].flow != "cpu" {
+			t.Errorf("sink %d: flow = %q, want cpu", i, s.calls[0].flow)
+		}
+	}
+}
+
+func TestSubscriptionDispatchANYRoundRobins(t *testing.T) {
+	sinks := []*recordingSink{{}, {}}
+	sub := &subscription{name: "any-sub", mode: "ANY"}
+	for _, s := range sinks {
+		sub.workers = append(sub.workers, newSinkWorker(s))
+	}
+
+	const messages = 10
+	for i := 0; i < messages; i++ {
+		sub.dispatch(subscriptionMsg{flow: "cpu", value: float64(i), ts: time.Unix(int64(i), 0)})
+	}
+	waitForCalls(t, sinks, messages/len(sinks))
+
+	for i, s := range sinks {
+		if got := s.len(); got != messages/len(sinks) {
+			t.Errorf("sink %d got %d messages, want %d", i, got, messages/len(sinks))
+		}
+	}
+}
+
+func TestSubscriptionDispatchNoWorkers(t *testing.T) {
+	sub := &subscription{name: "empty-sub", mode: "ANY"}
+	// must not panic on the empty-slice modulo in the ANY branch
+	sub.dispatch(subscriptionMsg{flow: "cpu", value: 1, ts: time.Unix(1, 0)})
+}
+
+func TestSinkWorkerEnqueueDropsWhenFull(t *testing.T) {
+	blocker := make(chan struct{})
+	w := &sinkWorker{sink: blockingSink{blocker}, queue: make(chan subscriptionMsg, 1)}
+	go w.run()
+	defer close(blocker)
+
+	// first message is picked up by run() and blocks it on blocker; the
+	// second fills the queue; the third has nowhere to go and must drop.
+	for i := 0; i < 3; i++ {
+		w.enqueue(subscriptionMsg{flow: "cpu", value: float64(i)})
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if dropped := atomic.LoadUint64(&w.dropped); dropped == 0 {
+		t.Errorf("dropped = %d, want at least 1", dropped)
+	}
+}
+
+// blockingSink blocks its first Send until blocker is closed, so tests can
+// reliably fill a sinkWorker's queue behind it.
+type blockingSink struct {
+	blocker chan struct{}
+}
+
+func (s blockingSink) Send(flow string, value float64, ts time.Time) {
+	<-s.blocker
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// defaultCompression is used whenever config.TDigestCompression is left
+// unset (zero). Higher values trade memory (~1-2KB per bucket at 100) for
+// more accurate quantiles.
+const defaultCompression = 100
+
+// centroid is one point of a t-digest: a mean and the number of samples
+// that were merged into it.
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+// tdigest is a per-second Dunning t-digest sketch: a small, sorted set of
+// centroids that approximates the distribution of the values added to it
+// well enough to answer arbitrary quantiles without keeping raw samples.
+type tdigest struct {
+	centroids   []centroid
+	compression float64
+
+	// totalWeight/weightedSum are the digest's running sample weight and
+	// weighted sum, kept alongside the centroids; totalWeight also scales
+	// the centroid-size bound and the quantile target.
+	totalWeight float64
+	weightedSum float64
+}
+
+func newTDigest(compression float64) *tdigest {
+	if compression <= 0 {
+		compression = defaultCompression
+	}
+	return &tdigest{compression: compression}
+}
+
+// addData merges x (a single sample) into the digest.
+func (td *tdigest) addData(x float64) {
+	td.add(x, 1)
+}
+
+// add merges x, weighted, into the nearest eligible centroid - the closest
+// one whose weight after the merge still respects the t-digest size bound
+// for its quantile - or inserts a new centroid when none qualifies.
+func (td *tdigest) add(x float64, weight float64) {
+	td.totalWeight += weight
+	td.weightedSum += x * weight
+
+	best := -1
+	bestDistance := math.MaxFloat64
+	cumulative := float64(0)
+	for i, c := range td.centroids {
+		q := (cumulative + c.weight/2) / td.totalWeight
+		limit := 4 * td.totalWeight * q * (1 - q) / td.compression
+		if c.weight+weight <= limit {
+			if distance := math.Abs(c.mean - x); distance < bestDistance {
+				bestDistance = distance
+				best = i
+			}
+		}
+		cumulative += c.weight
+	}
+
+	if best >= 0 {
+		c := &td.centroids[best]
+		c.mean = (c.mean*c.weight + x*weight) / (c.weight + weight)
+		c.weight += weight
+	} else {
+		// the bound above only approximates a centroid's quantile
+		// correctly when cumulative reflects its true rank, so new
+		// centroids must go in by sorted position rather than just being
+		// appended - otherwise every add before the next compress() scans
+		// centroids out of order.
+		idx := sort.Search(len(td.centroids), func(i int) bool { return td.centroids[i].mean >= x })
+		td.centroids = append(td.centroids, centroid{})
+		copy(td.centroids[idx+1:], td.centroids[idx:])
+		td.centroids[idx] = centroid{mean: x, weight: weight}
+	}
+
+	if len(td.centroids) > int(10*td.compression) {
+		td.compress()
+	}
+}
+
+// compress sorts centroids by mean and re-merges them left-to-right under
+// the same centroid-size bound, shrinking the digest back down.
+func (td *tdigest) compress() {
+	sort.Slice(td.centroids, func(i, j int) bool { return td.centroids[i].mean < td.centroids[j].mean })
+
+	merged := make([]centroid, 0, len(td.centroids))
+	cumulative := float64(0)
+	for _, c := range td.centroids {
+		if len(merged) > 0 {
+			last := &merged[len(merged)-1]
+			q := (cumulative - last.weight/2) / td.totalWeight
+			limit := 4 * td.totalWeight * q * (1 - q) / td.compression
+			if last.weight+c.weight <= limit {
+				last.mean = (last.mean*last.weight + c.mean*c.weight) / (last.weight + c.weight)
+				last.weight += c.weight
+				cumulative += c.weight
+				continue
+			}
+		}
+		merged = append(merged, c)
+		cumulative += c.weight
+	}
+	td.centroids = merged
+}
+
+// clone returns an independent copy of td, safe to read or merge into after
+// the lock protecting the original has been released.
+func (td *tdigest) clone() *tdigest {
+	centroids := make([]centroid, len(td.centroids))
+	copy(centroids, td.centroids)
+	return &tdigest{
+		centroids:   centroids,
+		compression: td.compression,
+		totalWeight: td.totalWeight,
+		weightedSum: td.weightedSum,
+	}
+}
+
+// merge folds other's centroids into td, e.g. to combine several per-second
+// digests into one spanning a wider window before answering a quantile.
+func (td *tdigest) merge(other *tdigest) {
+	if other == nil {
+		return
+	}
+	td.totalWeight += other.totalWeight
+	td.weightedSum += other.weightedSum
+	td.centroids = append(td.centroids, other.centroids...)
+	td.compress()
+}
+
+// quantile answers a q in [0,1] quantile query by walking cumulative
+// weight across the centroids and linearly interpolating between the
+// midpoints of the two centroids straddling the target weight.
+func (td *tdigest) quantile(q float64) float64 {
+	if len(td.centroids) == 0 || td.totalWeight == 0 {
+		return 0
+	}
+	sort.Slice(td.centroids, func(i, j int) bool { return td.centroids[i].mean < td.centroids[j].mean })
+	if len(td.centroids) == 1 {
+		return td.centroids[0].mean
+	}
+
+	target := q * td.totalWeight
+	cumulative := float64(0)
+	for i, c := range td.centroids {
+		midpoint := cumulative + c.weight/2
+		if i > 0 && (target <= midpoint || i == len(td.centroids)-1) {
+			prev := td.centroids[i-1]
+			prevMidpoint := cumulative - prev.weight/2
+			span := midpoint - prevMidpoint
+			if span <= 0 {
+				return c.mean
+			}
+			// target can fall outside [prevMidpoint, midpoint] when it's
+			// past the last centroid's midpoint (the i==len-1 branch above
+			// takes this path unconditionally); clamp instead of
+			// extrapolating past either centroid's mean.
+			fraction := (target - prevMidpoint) / span
+			if fraction < 0 {
+				fraction = 0
+			} else if fraction > 1 {
+				fraction = 1
+			}
+			return prev.mean + fraction*(c.mean-prev.mean)
+		}
+		cumulative += c.weight
+	}
+	return td.centroids[len(td.centroids)-1].mean
+}
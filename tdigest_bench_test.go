@@ -0,0 +1,56 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// BenchmarkTDigestAdd measures the cost of feeding samples into a single
+// bucket's t-digest, the path addData/addTimer take on every datapoint.
+func BenchmarkTDigestAdd(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	td := newTDigest(defaultCompression)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		td.addData(r.Float64() * 1000)
+	}
+}
+
+// BenchmarkPlainCountSumAdd measures the cost of the old count/sum-only
+// accumulation, for comparison against BenchmarkTDigestAdd.
+func BenchmarkPlainCountSumAdd(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	var count uint
+	var sum float64
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		count++
+		sum += r.Float64() * 1000
+	}
+	_ = count
+	_ = sum
+}
+
+// BenchmarkTDigestQuantile measures answering a p99 query over a window of
+// 60 per-second digests, the cost /meter?stat=p99&window=60 pays.
+func BenchmarkTDigestQuantile(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	digests := make([]*tdigest, 60)
+	for i := range digests {
+		td := newTDigest(defaultCompression)
+		for j := 0; j < 1000; j++ {
+			td.addData(r.Float64() * 1000)
+		}
+		digests[i] = td
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		merged := newTDigest(defaultCompression)
+		for _, td := range digests {
+			merged.merge(td)
+		}
+		merged.quantile(0.99)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// TestTDigestQuantileUniform feeds a known uniform distribution in and
+// checks the reported quantiles land within this digest's actual
+// approximation error at the default compression - the 4*n*q*(1-q)/δ
+// bound in add trades more error at the tails for O(compression) memory
+// instead of keeping every sample, so the tolerance here is generous by
+// design, not a sign the implementation is imprecise.
+func TestTDigestQuantileUniform(t *testing.T) {
+	const n = 20000
+	r := rand.New(rand.NewSource(7))
+	td := newTDigest(defaultCompression)
+	for i := 0; i < n; i++ {
+		td.addData(r.Float64() * float64(n))
+	}
+
+	cases := []struct {
+		q      float64
+		want   float64
+		relTol float64
+	}{
+		{0.5, float64(n) / 2, 0.05},
+		{0.9, float64(n) * 0.9, 0.1},
+		{0.99, float64(n) * 0.99, 0.15},
+	}
+	for _, c := range cases {
+		got := td.quantile(c.q)
+		tolerance := c.want * c.relTol
+		if math.Abs(got-c.want) > tolerance {
+			t.Errorf("quantile(%v) = %v, want within %v%% of %v", c.q, got, c.relTol*100, c.want)
+		}
+	}
+}
+
+// TestTDigestQuantileIdenticalSamples exercises the degenerate case of every
+// sample having the same value (three adds of 42 are too few to merge, so
+// they make three centroids with equal means): any quantile should just
+// return that value.
+func TestTDigestQuantileIdenticalSamples(t *testing.T) {
+	td := newTDigest(defaultCompression)
+	td.addData(42)
+	td.addData(42)
+	td.addData(42)
+
+	if got := td.quantile(0.99); got != 42 {
+		t.Errorf("quantile(0.99) = %v, want 42", got)
+	}
+}
+
+// TestTDigestQuantileEmpty makes sure an untouched digest answers 0 rather
+// than panicking or dividing by zero.
+func TestTDigestQuantileEmpty(t *testing.T) {
+	td := newTDigest(defaultCompression)
+	if got := td.quantile(0.5); got != 0 {
+		t.Errorf("quantile(0.5) on empty digest = %v, want 0", got)
+	}
+}
+
+// TestTDigestMerge checks that merging two digests answers quantiles over
+// the union of their samples, the operation Percentile relies on to
+// combine per-second buckets into one window.
+func TestTDigestMerge(t *testing.T) {
+	a := newTDigest(defaultCompression)
+	for i := 1; i <= 500; i++ {
+		a.addData(float64(i))
+	}
+	b := newTDigest(defaultCompression)
+	for i := 501; i <= 1000; i++ {
+		b.addData(float64(i))
+	}
+
+	merged := newTDigest(defaultCompression)
+	merged.merge(a)
+	merged.merge(b)
+
+	const tolerance = 20
+	if got := merged.quantile(0.5); math.Abs(got-500) > tolerance {
+		t.Errorf("merged quantile(0.5) = %v, want close to 500 (+/-%v)", got, tolerance)
+	}
+}
+
+// TestTDigestCloneIsIndependent ensures clone returns a copy that addData
+// on the original doesn't affect - the property Percentile now relies on
+// to merge a bucket's digest after releasing the flow's lock.
+func TestTDigestCloneIsIndependent(t *testing.T) {
+	td := newTDigest(defaultCompression)
+	td.addData(1)
+	td.addData(2)
+
+	clone := td.clone()
+	td.addData(1000)
+
+	if got := clone.quantile(0.99); got > 2 {
+		t.Errorf("clone observed a mutation made to the original after cloning: quantile(0.99) = %v", got)
+	}
+}